@@ -1,7 +1,10 @@
 package route
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -17,27 +20,67 @@ import (
 	"github.com/grafana/metrictank/cluster/partitioner"
 	"github.com/grafana/metrictank/schema"
 	"github.com/graphite-ng/carbon-relay-ng/persister"
+	"github.com/xdg-go/scram"
 )
 
+// KafkaTLSConfig holds the TLS settings for a KafkaMdm route. ClientCert and
+// ClientKey are optional and only needed for mutual TLS; CaCert is optional
+// and defaults to the system cert pool when empty.
+type KafkaTLSConfig struct {
+	Enabled            bool
+	CaCert             string
+	ClientCert         string
+	ClientKey          string
+	InsecureSkipVerify bool
+}
+
+// KafkaSASLConfig holds the SASL settings for a KafkaMdm route. Mechanism is
+// one of "PLAIN", "SCRAM-SHA-256" or "SCRAM-SHA-512".
+type KafkaSASLConfig struct {
+	Enabled   bool
+	Mechanism string
+	Username  string
+	Password  string
+}
+
+// kafkaMdmMsgMeta travels alongside a ProducerMessage via its Metadata field
+// so that the Errors() drain loop can retry an individual message without
+// holding up (or resubmitting) the rest of the batch.
+type kafkaMdmMsgMeta struct {
+	metric  *schema.MetricData
+	size    int
+	retries int
+}
+
 type KafkaMdm struct {
 	baseRoute
 	saramaCfg     *sarama.Config
-	producer      sarama.SyncProducer
+	producer      sarama.AsyncProducer
 	topic         string
 	numPartitions int32
 	brokers       []string
 	buf           chan []byte
 	partitioner   *partitioner.Kafka
+	encoder       PayloadEncoder
 	schemas       persister.WhisperSchemas
 	blocking      bool
 	dispatch      func(chan []byte, []byte, metrics.Gauge, metrics.Counter)
 
+	wal              *wal  // non-nil only when dispatch mode is "spillover"
+	replayingInitial int32 // 1 while run() is still draining pre-existing WAL segments on startup. managed via sync/atomic
+
 	orgId int // organisation to publish data under
 
 	bufSize      int // amount of messages we can buffer up. each message is about 100B. so 1e7 is about 1GB.
 	flushMaxNum  int
 	flushMaxWait time.Duration
 
+	asyncMaxInflight    int           // backpressure kicks in once this many bytes are submitted to kafka and not yet acked
+	asyncFlushFrequency time.Duration // sarama.Producer.Flush.Frequency: max time queued messages sit before being sent
+	asyncFlushMessages  int           // sarama.Producer.Flush.Messages: max queued messages before they're sent
+
+	inFlight int64 // bytes currently submitted to the producer and not yet acked. managed via sync/atomic
+
 	numErrFlush       metrics.Counter
 	numOut            metrics.Counter   // metrics successfully written to kafka
 	numDropBuffFull   metrics.Counter   // metric drops due to queue full
@@ -47,11 +90,26 @@ type KafkaMdm struct {
 	manuFlushSize     metrics.Histogram // only updated after successful flush. not implemented yet
 	numBuffered       metrics.Gauge
 	bufferSize        metrics.Gauge
+	numSpilled        metrics.Counter // metrics written to the spillover WAL because the buffer was above its high-water mark
+	spillBytes        metrics.Counter // bytes written to the spillover WAL
+	numReplayed       metrics.Counter // metrics re-injected into buf from the spillover WAL
+
+	prom *kafkaMdmPromMetrics // parallel prometheus registration of the above, for operators scraping Prometheus instead of go-metrics
+
+	runDone chan struct{} // closed once run() returns, so Shutdown() knows it's safe to close the producer
+	done    chan struct{} // closed by Shutdown() to stop the route's background goroutines, before r.buf is closed
+
+	walWG   sync.WaitGroup // tracks the background WAL replay goroutine, so Shutdown() can join it before closing r.buf
+	retryWG sync.WaitGroup // tracks in-flight retry() goroutines, so Shutdown() can join them before closing the producer
 }
 
+// spillHighWaterFrac is the fraction of bufSize at or above which spillover
+// mode starts writing incoming buffers to the WAL instead of the channel.
+const spillHighWaterFrac = 0.9
+
 // NewKafkaMdm creates a special route that writes to a grafana.net datastore
 // We will automatically run the route and the destination
-func NewKafkaMdm(key, prefix, sub, regex, topic, codec, schemasFile, partitionBy string, brokers []string, bufSize, orgId, flushMaxNum, flushMaxWait, timeout int, blocking bool) (Route, error) {
+func NewKafkaMdm(key, prefix, sub, regex, topic, codec, format, schemasFile, partitionBy string, brokers []string, bufSize, orgId, flushMaxNum, flushMaxWait, timeout int, blocking bool, asyncMaxInflight, asyncFlushFrequency, asyncFlushMessages int, tlsCfg KafkaTLSConfig, saslCfg KafkaSASLConfig, spillDir string, spillMaxBytes int64, promListenAddr string) (Route, error) {
 	m, err := matcher.New(prefix, sub, regex)
 	if err != nil {
 		return nil, err
@@ -60,6 +118,10 @@ func NewKafkaMdm(key, prefix, sub, regex, topic, codec, schemasFile, partitionBy
 	if err != nil {
 		return nil, err
 	}
+	encoder, err := getEncoder(format)
+	if err != nil {
+		return nil, err
+	}
 
 	cleanAddr := util.AddrToPath(brokers[0])
 
@@ -69,13 +131,20 @@ func NewKafkaMdm(key, prefix, sub, regex, topic, codec, schemasFile, partitionBy
 		brokers:   brokers,
 		buf:       make(chan []byte, bufSize),
 		schemas:   schemas,
+		encoder:   encoder,
 		blocking:  blocking,
 		orgId:     orgId,
+		runDone:   make(chan struct{}),
+		done:      make(chan struct{}),
 
 		bufSize:      bufSize,
 		flushMaxNum:  flushMaxNum,
 		flushMaxWait: time.Duration(flushMaxWait) * time.Millisecond,
 
+		asyncMaxInflight:    asyncMaxInflight,
+		asyncFlushFrequency: time.Duration(asyncFlushFrequency) * time.Millisecond,
+		asyncFlushMessages:  asyncFlushMessages,
+
 		numErrFlush:       stats.Counter("dest=" + cleanAddr + ".unit=Err.type=flush"),
 		numOut:            stats.Counter("dest=" + cleanAddr + ".unit=Metric.direction=out"),
 		durationTickFlush: stats.Timer("dest=" + cleanAddr + ".what=durationFlush.type=ticker"),
@@ -85,10 +154,26 @@ func NewKafkaMdm(key, prefix, sub, regex, topic, codec, schemasFile, partitionBy
 		numBuffered:       stats.Gauge("dest=" + cleanAddr + ".unit=Metric.what=numBuffered"),
 		bufferSize:        stats.Gauge("dest=" + cleanAddr + ".unit=Metric.what=bufferSize"),
 		numDropBuffFull:   stats.Counter("dest=" + cleanAddr + ".unit=Metric.action=drop.reason=queue_full"),
+		numSpilled:        stats.Counter("dest=" + cleanAddr + ".unit=Metric.action=spill"),
+		spillBytes:        stats.Counter("dest=" + cleanAddr + ".unit=B.what=spillBytes"),
+		numReplayed:       stats.Counter("dest=" + cleanAddr + ".unit=Metric.action=replay"),
 	}
 	r.bufferSize.Update(int64(bufSize))
 
-	if blocking {
+	r.prom = newKafkaMdmPromMetrics(key, topic, cleanAddr)
+	r.prom.bufferSize.Set(float64(bufSize))
+	go r.mirrorDropCounter()
+
+	if promListenAddr != "" {
+		startMetricsServer(promListenAddr)
+	}
+
+	if spillDir != "" {
+		r.wal, err = newWAL(spillDir, spillMaxBytes)
+		if err != nil {
+			log.Fatalf("kafkaMdm %q: failed to initialize spillover WAL. %s", r.key, err)
+		}
+	} else if blocking {
 		r.dispatch = dispatchBlocking
 	} else {
 		r.dispatch = dispatchNonBlocking
@@ -103,6 +188,7 @@ func NewKafkaMdm(key, prefix, sub, regex, topic, codec, schemasFile, partitionBy
 	// Because we don't change the flush settings, sarama will try to produce messages
 	// as fast as possible to keep latency low.
 	config := sarama.NewConfig()
+	registerSaramaMetrics(config.MetricRegistry, key, topic, cleanAddr, r.done)
 	config.Producer.RequiredAcks = sarama.WaitForAll // Wait for all in-sync replicas to ack the message
 	config.Producer.Retry.Max = 10                   // Retry up to 10 times to produce the message
 	config.Producer.Compression, err = getCompression(codec)
@@ -110,7 +196,38 @@ func NewKafkaMdm(key, prefix, sub, regex, topic, codec, schemasFile, partitionBy
 		log.Fatalf("kafkaMdm %q: %s", r.key, err)
 	}
 	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
 	config.Producer.Timeout = time.Duration(timeout) * time.Millisecond
+	config.Producer.Flush.Frequency = r.asyncFlushFrequency
+	config.Producer.Flush.Messages = r.asyncFlushMessages
+
+	if tlsCfg.Enabled {
+		tlsConfig, err := newTLSConfig(tlsCfg)
+		if err != nil {
+			log.Fatalf("kafkaMdm %q: failed to configure TLS. %s", r.key, err)
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+
+	if saslCfg.Enabled {
+		config.Net.SASL.Enable = true
+		config.Net.SASL.User = saslCfg.Username
+		config.Net.SASL.Password = saslCfg.Password
+		switch saslCfg.Mechanism {
+		case "PLAIN", "":
+			config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		case "SCRAM-SHA-256":
+			config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+			config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &scramClient{HashGeneratorFcn: scram.SHA256} }
+		case "SCRAM-SHA-512":
+			config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+			config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &scramClient{HashGeneratorFcn: scram.SHA512} }
+		default:
+			log.Fatalf("kafkaMdm %q: unknown SASL mechanism %q", r.key, saslCfg.Mechanism)
+		}
+	}
+
 	err = config.Validate()
 	if err != nil {
 		log.Fatalf("kafkaMdm %q: failed to validate kafka config. %s", r.key, err)
@@ -123,100 +240,125 @@ func NewKafkaMdm(key, prefix, sub, regex, topic, codec, schemasFile, partitionBy
 }
 
 func (r *KafkaMdm) run() {
+	defer close(r.runDone)
+
 	metrics := make([]*schema.MetricData, 0, r.flushMaxNum)
 	ticker := time.NewTicker(r.flushMaxWait)
 	var client sarama.Client
 	var err error
 	attempts := 0
 
-	for r.producer == nil {
-		client, err = sarama.NewClient(r.brokers, r.saramaCfg)
-		if err == sarama.ErrOutOfBrokers {
-			log.Warnf("kafkaMdm %q: %s", r.key, err)
-			// sleep before trying to connect again.
-			time.Sleep(time.Second)
-			attempts++
-			// fail after 300 attempts
-			if attempts > 300 {
-				log.Fatalf("kafkaMdm %q: no kafka brokers available.", r.key)
-			}
-			continue
-		} else if err != nil {
-			log.Fatalf("kafkaMdm %q: failed to initialize kafka producer. %s", r.key, err)
-		}
-
-		partitions, err := client.Partitions(r.topic)
+	if path, ok := parseInprocBroker(r.brokers); ok {
+		// embedded deployments skip the real broker/client dance entirely and
+		// talk to a local, boltdb-backed stand-in instead.
+		r.numPartitions = 1
+		r.producer, err = newInprocBroker(path, r.numPartitions)
 		if err != nil {
-			log.Fatalf("kafkaMdm %q: failed to get partitions for topic %s - %s", r.key, r.topic, err)
-		}
-		if len(partitions) < 1 {
-			log.Fatalf("kafkaMdm %q: retrieved 0 partitions for topic %s\nThis might indicate that kafka is not in a ready state.", r.key, r.topic)
+			log.Fatalf("kafkaMdm %q: %s", r.key, err)
 		}
+		log.Infof("kafkaMdm %q: using embedded in-process kafka store at %s", r.key, path)
+	} else {
+		for r.producer == nil {
+			client, err = sarama.NewClient(r.brokers, r.saramaCfg)
+			if err == sarama.ErrOutOfBrokers {
+				log.Warnf("kafkaMdm %q: %s", r.key, err)
+				// sleep before trying to connect again.
+				time.Sleep(time.Second)
+				attempts++
+				// fail after 300 attempts
+				if attempts > 300 {
+					log.Fatalf("kafkaMdm %q: no kafka brokers available.", r.key)
+				}
+				continue
+			} else if err != nil {
+				log.Fatalf("kafkaMdm %q: failed to initialize kafka producer. %s", r.key, err)
+			}
 
-		r.numPartitions = int32(len(partitions))
+			partitions, err := client.Partitions(r.topic)
+			if err != nil {
+				log.Fatalf("kafkaMdm %q: failed to get partitions for topic %s - %s", r.key, r.topic, err)
+			}
+			if len(partitions) < 1 {
+				log.Fatalf("kafkaMdm %q: retrieved 0 partitions for topic %s\nThis might indicate that kafka is not in a ready state.", r.key, r.topic)
+			}
 
-		r.producer, err = sarama.NewSyncProducerFromClient(client)
-		if err != nil {
-			log.Fatalf("kafkaMdm %q: failed to initialize kafka producer. %s", r.key, err)
+			r.numPartitions = int32(len(partitions))
+
+			r.producer, err = sarama.NewAsyncProducerFromClient(client)
+			if err != nil {
+				log.Fatalf("kafkaMdm %q: failed to initialize kafka producer. %s", r.key, err)
+			}
 		}
+		// sarama documentation states that we need to call Close() on the client
+		// used to create the AsyncProducer
+		defer client.Close()
 	}
-	// sarama documentation states that we need to call Close() on the client
-	// used to create the SyncProducer
-	defer client.Close()
 
 	log.Infof("kafkaMdm %q: now connected to kafka", r.key)
 
-	// flushes the data to kafka and resets buffer.  blocks until it succeeds
-	flush := func() {
-		for {
-			pre := time.Now()
-			size := 0
+	go r.drainSuccesses()
+	go r.drainErrors()
+	if r.wal != nil {
+		// block dispatchSpillover from writing straight into r.buf until the
+		// backlog from a previous run has drained, so old data is always
+		// ordered ahead of new traffic. replayInitial clears the flag and
+		// falls through to the steady-state replayWAL loop once caught up.
+		// walWG lets Shutdown() join this goroutine before closing r.buf.
+		atomic.StoreInt32(&r.replayingInitial, 1)
+		r.walWG.Add(1)
+		go func() {
+			defer r.walWG.Done()
+			r.replayInitial()
+		}()
+	}
 
-			payload := make([]*sarama.ProducerMessage, len(metrics))
+	// submits metrics to the producer's input channel, applying backpressure
+	// once asyncMaxInflight bytes are outstanding. unlike the old sync flush,
+	// this returns as soon as the batch has been handed off; acking happens
+	// asynchronously in drainSuccesses/drainErrors.
+	flush := func() {
+		pre := time.Now()
+		size := 0
 
-			for i, metric := range metrics {
-				var data []byte
-				data, err = metric.MarshalMsg(data[:])
-				if err != nil {
-					panic(err)
-				}
-				size += len(data)
+		for _, metric := range metrics {
+			key, data, err := r.encoder.Encode(metric)
+			if err != nil {
+				panic(err)
+			}
 
-				partition, err := r.partitioner.Partition(metric, r.numPartitions)
-				if err != nil {
-					panic(err)
-				}
-				payload[i] = &sarama.ProducerMessage{
-					Partition: partition,
-					Topic:     r.topic,
-					Value:     sarama.ByteEncoder(data),
-				}
+			// partitioning is decoupled from the payload encoding: it always
+			// keys off the metric itself, so partitionBy=host|metric|series
+			// behaves the same regardless of the chosen format.
+			partition, err := r.partitioner.Partition(metric, r.numPartitions)
+			if err != nil {
+				panic(err)
 			}
-			err = r.producer.SendMessages(payload)
-
-			diff := time.Since(pre)
-			if err == nil {
-				log.Debugf("KafkaMdm %q: sent %d metrics in %s - msg size %d", r.key, len(metrics), diff, size)
-				r.numOut.Inc(int64(len(metrics)))
-				r.tickFlushSize.Update(int64(size))
-				r.durationTickFlush.Update(diff)
-				metrics = metrics[:0]
-				break
+
+			for atomic.LoadInt64(&r.inFlight) > int64(r.asyncMaxInflight) {
+				time.Sleep(time.Millisecond)
 			}
+			atomic.AddInt64(&r.inFlight, int64(len(data)))
 
-			errors := make(map[error]int)
-			for _, e := range err.(sarama.ProducerErrors) {
-				errors[e.Err] += 1
+			msg := &sarama.ProducerMessage{
+				Partition: partition,
+				Topic:     r.topic,
+				Value:     sarama.ByteEncoder(data),
+				Metadata:  kafkaMdmMsgMeta{metric: metric, size: len(data)},
 			}
-			for k, v := range errors {
-				log.Warnf("KafkaMdm %q: seen %d times: %s", r.key, v, k)
+			if key != nil {
+				msg.Key = sarama.ByteEncoder(key)
 			}
-
-			r.numErrFlush.Inc(1)
-			log.Warnf("KafkaMdm %q: failed to submit data: %s will try again in 100ms. (this attempt took %s)", r.key, err, diff)
-
-			time.Sleep(100 * time.Millisecond)
+			r.producer.Input() <- msg
+			size += len(data)
 		}
+
+		diff := time.Since(pre)
+		log.Debugf("KafkaMdm %q: submitted %d metrics in %s - msg size %d", r.key, len(metrics), diff, size)
+		r.tickFlushSize.Update(int64(size))
+		r.durationTickFlush.Update(diff)
+		r.prom.tickFlushSize.Observe(float64(size))
+		r.prom.durationTickFlush.Observe(diff.Seconds())
+		metrics = metrics[:0]
 	}
 	for {
 		select {
@@ -228,6 +370,7 @@ func (r *KafkaMdm) run() {
 				return
 			}
 			r.numBuffered.Dec(1)
+			r.prom.numBuffered.Dec()
 			md, err := parseMetric(buf, r.schemas, r.orgId)
 			if err != nil {
 				log.Errorf("KafkaMdm %q: parseMetric failed, skipping metric: %s", r.key, err)
@@ -246,11 +389,213 @@ func (r *KafkaMdm) run() {
 	}
 }
 
+// drainSuccesses consumes acked messages off the producer's Successes channel,
+// releases their in-flight byte accounting and updates numOut.
+func (r *KafkaMdm) drainSuccesses() {
+	for msg := range r.producer.Successes() {
+		meta := msg.Metadata.(kafkaMdmMsgMeta)
+		atomic.AddInt64(&r.inFlight, -int64(meta.size))
+		r.numOut.Inc(1)
+		r.prom.numOut.Inc()
+	}
+}
+
+// drainErrors consumes failed messages off the producer's Errors channel and
+// retries each one individually with exponential backoff, so a single bad
+// partition can't block the rest of the batch. Each retry is tracked in
+// retryWG so Shutdown() can wait for outstanding retries to finish (or bail
+// out cleanly via r.done) instead of racing producer.Close().
+func (r *KafkaMdm) drainErrors() {
+	for pErr := range r.producer.Errors() {
+		meta := pErr.Msg.Metadata.(kafkaMdmMsgMeta)
+		r.numErrFlush.Inc(1)
+		r.prom.numErrFlush.Inc()
+		log.Warnf("KafkaMdm %q: failed to submit metric %q (retry %d): %s", r.key, meta.metric.Name, meta.retries, pErr.Err)
+		r.retryWG.Add(1)
+		go func(msg *sarama.ProducerMessage, meta kafkaMdmMsgMeta) {
+			defer r.retryWG.Done()
+			r.retry(msg, meta)
+		}(pErr.Msg, meta)
+	}
+}
+
+// kafkaMdmMaxRetries caps how many times a single message is retried before
+// it's given up on. Without a cap, a message that can never succeed (bad
+// topic, oversized payload, stale auth) would retry forever and keep its
+// bytes counted against r.inFlight permanently, eventually wedging the
+// backpressure check in flush() for every other metric too.
+const kafkaMdmMaxRetries = 12
+
+// retry backs off exponentially (capped at 30s) and resubmits a single
+// message. it does not block drainErrors since it runs in its own goroutine.
+// once a message has been retried kafkaMdmMaxRetries times, it's dropped and
+// its in-flight bytes released. Both the backoff and the final resubmission
+// also select on r.done, so a retry in flight during Shutdown() gives up and
+// releases its in-flight bytes instead of racing producer.Close() with a
+// send on Input() - that send would otherwise panic once the producer is
+// considered closed.
+func (r *KafkaMdm) retry(msg *sarama.ProducerMessage, meta kafkaMdmMsgMeta) {
+	if meta.retries >= kafkaMdmMaxRetries {
+		atomic.AddInt64(&r.inFlight, -int64(meta.size))
+		log.Errorf("KafkaMdm %q: giving up on metric %q after %d retries, dropping it", r.key, meta.metric.Name, meta.retries)
+		return
+	}
+
+	backoff := 100 * time.Millisecond << uint(meta.retries)
+	if backoff > 30*time.Second || backoff <= 0 {
+		backoff = 30 * time.Second
+	}
+
+	select {
+	case <-time.After(backoff):
+	case <-r.done:
+		atomic.AddInt64(&r.inFlight, -int64(meta.size))
+		log.Warnf("KafkaMdm %q: shutting down, giving up on metric %q mid-retry", r.key, meta.metric.Name)
+		return
+	}
+
+	meta.retries++
+	msg.Metadata = meta
+	select {
+	case r.producer.Input() <- msg:
+	case <-r.done:
+		atomic.AddInt64(&r.inFlight, -int64(meta.size))
+		log.Warnf("KafkaMdm %q: shutting down, giving up on metric %q mid-retry", r.key, meta.metric.Name)
+	}
+}
+
 func (r *KafkaMdm) Dispatch(buf []byte) {
 	log.Tracef("kafkaMdm %q: sending to dest %v: %s", r.key, r.brokers, buf)
+	if r.wal != nil {
+		r.dispatchSpillover(buf)
+		return
+	}
 	r.dispatch(r.buf, buf, r.numBuffered, r.numDropBuffFull)
 }
 
+// dispatchSpillover is used in spillover mode instead of r.dispatch: below
+// the high-water mark it behaves like dispatchNonBlocking, but once the
+// in-memory buffer is mostly full it writes to the on-disk WAL instead of
+// dropping the metric, so it survives until a background reader (see
+// replayWAL) can re-inject it once there's room again. While the startup
+// replay (see run()) is still catching up on pre-existing segments, every
+// call spills unconditionally, so old data always drains into r.buf ahead of
+// anything dispatched after this process started.
+func (r *KafkaMdm) dispatchSpillover(buf []byte) {
+	if atomic.LoadInt32(&r.replayingInitial) == 0 {
+		highWater := int(float64(r.bufSize) * spillHighWaterFrac)
+		if len(r.buf) < highWater {
+			select {
+			case r.buf <- buf:
+				r.numBuffered.Inc(1)
+				r.prom.numBuffered.Inc()
+				return
+			default:
+			}
+		}
+	}
+
+	if err := r.wal.Write(buf); err != nil {
+		r.numDropBuffFull.Inc(1)
+		log.Warnf("kafkaMdm %q: spillover WAL full, dropping metric: %s", r.key, err)
+		return
+	}
+	r.numSpilled.Inc(1)
+	r.spillBytes.Inc(int64(len(buf)))
+	r.prom.numSpilled.Inc()
+	r.prom.spillBytes.Add(float64(len(buf)))
+}
+
+// errReplayAborted is returned up through replaySealedSegments once Shutdown()
+// closes r.done, so replayInitial/replayWAL can stop instead of trying another
+// pass. The sealed segment being replayed when this happens is left on disk
+// exactly where it was - replaySegment only removes a segment once every
+// record in it has been consumed - so it's picked up again on next startup.
+var errReplayAborted = fmt.Errorf("kafkaMdm: spillover replay aborted by shutdown")
+
+// replayInitial drains every spillover segment that already existed when
+// this route started, before dispatchSpillover starts accepting new traffic
+// into the buffer directly (see replayingInitial). It runs in its own
+// goroutine (started from run(), tracked via walWG) so that run()'s own
+// select loop, which is what actually drains r.buf into the producer, can
+// make room for it concurrently instead of deadlocking.
+func (r *KafkaMdm) replayInitial() {
+	log.Infof("kafkaMdm %q: replaying pre-existing spillover segments before accepting new traffic", r.key)
+	if err := r.replaySealedSegments(); err != nil {
+		return
+	}
+	atomic.StoreInt32(&r.replayingInitial, 0)
+	log.Infof("kafkaMdm %q: spillover replay caught up, resuming normal dispatch", r.key)
+	r.replayWAL()
+}
+
+// replayWAL periodically moves records out of the spillover WAL and back
+// into r.buf, oldest segment first, until done is closed. It backs off
+// whenever there's nothing to replay or the buffer has no room, so it
+// naturally re-injects spilled traffic as soon as Kafka (and thus the
+// buffer) is healthy again.
+func (r *KafkaMdm) replayWAL() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// once the buffer has room, seal the segment currently being
+			// written so its records become replayable without waiting for
+			// it to reach walSegmentBytes.
+			if len(r.buf) < int(float64(r.bufSize)*spillHighWaterFrac) {
+				r.wal.mu.Lock()
+				err := r.wal.rotate()
+				r.wal.mu.Unlock()
+				if err != nil {
+					log.Warnf("kafkaMdm %q: failed to seal spillover segment: %s", r.key, err)
+				}
+			}
+			if err := r.replaySealedSegments(); err != nil {
+				return
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// replaySealedSegments does one pass over the WAL's currently-sealed
+// segments, re-injecting every record into r.buf. It returns errReplayAborted
+// if r.done is closed while it's blocked handing a record to r.buf, since
+// Shutdown() closes r.buf only once it has joined walWG - a blind
+// `r.buf <- buf` here would otherwise risk sending on a channel Shutdown()
+// just closed out from under it.
+func (r *KafkaMdm) replaySealedSegments() error {
+	sealed, err := r.wal.sealedSegments()
+	if err != nil {
+		log.Warnf("kafkaMdm %q: failed to list spillover segments: %s", r.key, err)
+		return nil
+	}
+	for _, seg := range sealed {
+		err := r.wal.replaySegment(seg, func(buf []byte) error {
+			select {
+			case r.buf <- buf:
+			case <-r.done:
+				return errReplayAborted
+			}
+			r.numBuffered.Inc(1)
+			r.numReplayed.Inc(1)
+			r.prom.numBuffered.Inc()
+			r.prom.numReplayed.Inc()
+			return nil
+		})
+		if err == errReplayAborted {
+			log.Infof("kafkaMdm %q: aborting spillover replay, shutting down", r.key)
+			return errReplayAborted
+		}
+		if err != nil {
+			log.Warnf("kafkaMdm %q: failed to replay spillover segment %s: %s", r.key, seg, err)
+		}
+	}
+	return nil
+}
+
 func (r *KafkaMdm) Flush() error {
 	//conf := r.config.Load().(Config)
 	// no-op. Flush() is currently not called by anything.
@@ -259,7 +604,35 @@ func (r *KafkaMdm) Flush() error {
 
 func (r *KafkaMdm) Shutdown() error {
 	//conf := r.config.Load().(Config)
+
+	// close(r.done) first, before anything else: replaySealedSegments'
+	// send to r.buf and retry()'s backoff/resubmit both select on r.done, so
+	// this is what makes them let go of (or never take) a blocking send
+	// instead of racing the channel closes below. Only once walWG confirms
+	// the replay goroutine has actually stopped touching r.buf is it safe to
+	// close it - otherwise a replay blocked on `r.buf <- buf` while the
+	// buffer is full (the exact scenario spillover exists for) would panic
+	// with a send on a closed channel.
+	close(r.done)
+	r.walWG.Wait()
+
 	close(r.buf)
+	// wait for run() to flush whatever was left in the buffer and return
+	// before closing the producer, so drainSuccesses/drainErrors (which range
+	// over its Successes()/Errors() channels) exit instead of leaking.
+	<-r.runDone
+
+	if r.producer != nil {
+		if err := r.producer.Close(); err != nil {
+			log.Warnf("kafkaMdm %q: failed to close producer cleanly: %s", r.key, err)
+		}
+	}
+	// producer.Close() above is what stops drainErrors from spawning further
+	// retry() goroutines (its Errors() channel closes), so only now is it
+	// safe to wait for any already in flight - each of those also observes
+	// r.done and gives up promptly instead of sending to the now-closed
+	// producer.
+	r.retryWG.Wait()
 	return nil
 }
 
@@ -267,6 +640,60 @@ func (r *KafkaMdm) Snapshot() Snapshot {
 	return makeSnapshot(&r.baseRoute, "KafkaMdm")
 }
 
+// newTLSConfig builds a *tls.Config from a KafkaTLSConfig. When CaCert is
+// empty, the system cert pool is used instead.
+func newTLSConfig(cfg KafkaTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+
+	if cfg.CaCert != "" {
+		caCert, err := ioutil.ReadFile(cfg.CaCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA cert %q: %s", cfg.CaCert, err)
+		}
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("failed to parse CA cert %q", cfg.CaCert)
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+
+	if cfg.ClientCert != "" && cfg.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client keypair: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// scramClient adapts xdg-go/scram to sarama's SCRAMClient interface for the
+// SCRAM-SHA-256/SCRAM-SHA-512 SASL mechanisms.
+type scramClient struct {
+	*scram.Client
+	*scram.ClientConversation
+	scram.HashGeneratorFcn
+}
+
+func (c *scramClient) Begin(userName, password, authzID string) error {
+	client, err := c.HashGeneratorFcn.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	c.Client = client
+	c.ClientConversation = c.Client.NewConversation()
+	return nil
+}
+
+func (c *scramClient) Step(challenge string) (string, error) {
+	return c.ClientConversation.Step(challenge)
+}
+
+func (c *scramClient) Done() bool {
+	return c.ClientConversation.Done()
+}
+
 func getCompression(codec string) (sarama.CompressionCodec, error) {
 	switch codec {
 	case "none":
@@ -0,0 +1,76 @@
+package route
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/grafana/metrictank/schema"
+)
+
+// PayloadEncoder turns a MetricData point into the key and value bytes that
+// get put on the wire. KafkaMdm originally only ever wrote metrictank's msgp
+// schema; encoders let the same route feed consumers that speak a different
+// format, without touching the partitioning logic in run().
+type PayloadEncoder interface {
+	// Encode returns the key and value to use for the kafka message
+	// representing md. Either may be nil.
+	Encode(md *schema.MetricData) (key, value []byte, err error)
+}
+
+// getEncoder resolves the `format` route parameter to a PayloadEncoder.
+// "msgp" (metrictank's MessagePack schema) remains the default so existing
+// route definitions keep behaving exactly as before.
+func getEncoder(format string) (PayloadEncoder, error) {
+	switch format {
+	case "", "msgp":
+		return msgpEncoder{}, nil
+	case "json":
+		return jsonEncoder{}, nil
+	case "influx-line":
+		return influxLineEncoder{}, nil
+	case "protobuf":
+		// Unlike msgp/json/influx-line above, this format is not actually
+		// delivered: schema.MetricData has no protobuf Marshal method in
+		// the schema version this route is built against, and there is no
+		// protobuf message type anywhere in this tree to encode to.
+		// Shipping a fake/partial encoder would be worse than refusing it
+		// outright, so format: protobuf remains an open gap with no
+		// implementation path until a protobuf schema for MetricData
+		// exists - it is not simply unwired, it is unimplemented.
+		return nil, fmt.Errorf("payload format %q is not implemented: no protobuf schema is available for schema.MetricData", format)
+	}
+	return nil, fmt.Errorf("unknown payload format %q", format)
+}
+
+// msgpEncoder is the original metrictank MessagePack schema.
+type msgpEncoder struct{}
+
+func (msgpEncoder) Encode(md *schema.MetricData) ([]byte, []byte, error) {
+	value, err := md.MarshalMsg(nil)
+	return nil, value, err
+}
+
+// jsonEncoder encodes the metric as schema.MetricData's JSON representation,
+// for generic stream processors that don't speak msgp.
+type jsonEncoder struct{}
+
+func (jsonEncoder) Encode(md *schema.MetricData) ([]byte, []byte, error) {
+	value, err := json.Marshal(md)
+	return nil, value, err
+}
+
+// influxLineEncoder encodes the metric as an InfluxDB line-protocol point,
+// with tags carried over as line-protocol tags, for Elastic/Beats-style
+// ingest pipelines that expect that format on their Kafka input topics.
+type influxLineEncoder struct{}
+
+func (influxLineEncoder) Encode(md *schema.MetricData) ([]byte, []byte, error) {
+	line := md.Name
+	for _, tag := range md.Tags {
+		line += "," + tag
+	}
+	// line protocol's default precision is nanoseconds; md.Time is unix seconds.
+	line += fmt.Sprintf(" value=%s %d", strconv.FormatFloat(md.Value, 'f', -1, 64), md.Time*1e9)
+	return []byte(md.Name), []byte(line), nil
+}
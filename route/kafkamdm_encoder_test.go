@@ -0,0 +1,109 @@
+package route
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/grafana/metrictank/schema"
+)
+
+func testMetricData() *schema.MetricData {
+	return &schema.MetricData{
+		Name:  "a.b.c",
+		Value: 1.5,
+		Time:  1234567890,
+		Tags:  []string{"host=foo"},
+	}
+}
+
+func TestGetEncoderDefaultsToMsgp(t *testing.T) {
+	enc, err := getEncoder("")
+	if err != nil {
+		t.Fatalf("getEncoder(\"\"): %s", err)
+	}
+	if _, ok := enc.(msgpEncoder); !ok {
+		t.Fatalf("expected the empty format to resolve to msgpEncoder, got %T", enc)
+	}
+	if enc2, _ := getEncoder("msgp"); enc2 != enc {
+		t.Fatalf("expected \"msgp\" to resolve the same as \"\"")
+	}
+}
+
+func TestGetEncoderUnknownFormat(t *testing.T) {
+	if _, err := getEncoder("bogus"); err == nil {
+		t.Fatalf("expected an error for an unknown format")
+	}
+}
+
+func TestGetEncoderProtobufNotImplemented(t *testing.T) {
+	if _, err := getEncoder("protobuf"); err == nil {
+		t.Fatalf("expected protobuf to be rejected until a real schema type backs it")
+	}
+}
+
+func TestMsgpEncoder(t *testing.T) {
+	md := testMetricData()
+	key, value, err := msgpEncoder{}.Encode(md)
+	if err != nil {
+		t.Fatalf("Encode: %s", err)
+	}
+	if key != nil {
+		t.Fatalf("expected msgpEncoder to leave the key unset, got %q", key)
+	}
+	if len(value) == 0 {
+		t.Fatalf("expected a non-empty msgp payload")
+	}
+
+	var out schema.MetricData
+	if _, err := out.UnmarshalMsg(value); err != nil {
+		t.Fatalf("UnmarshalMsg: %s", err)
+	}
+	if out.Name != md.Name || out.Value != md.Value {
+		t.Fatalf("round-tripped metric %+v does not match original %+v", out, md)
+	}
+}
+
+func TestJSONEncoder(t *testing.T) {
+	md := testMetricData()
+	key, value, err := jsonEncoder{}.Encode(md)
+	if err != nil {
+		t.Fatalf("Encode: %s", err)
+	}
+	if key != nil {
+		t.Fatalf("expected jsonEncoder to leave the key unset, got %q", key)
+	}
+
+	var out schema.MetricData
+	if err := json.Unmarshal(value, &out); err != nil {
+		t.Fatalf("json.Unmarshal: %s", err)
+	}
+	if out.Name != md.Name || out.Value != md.Value {
+		t.Fatalf("round-tripped metric %+v does not match original %+v", out, md)
+	}
+}
+
+func TestInfluxLineEncoder(t *testing.T) {
+	md := testMetricData()
+	key, value, err := influxLineEncoder{}.Encode(md)
+	if err != nil {
+		t.Fatalf("Encode: %s", err)
+	}
+	if string(key) != md.Name {
+		t.Fatalf("expected key %q, got %q", md.Name, key)
+	}
+
+	line := string(value)
+	if !strings.HasPrefix(line, md.Name+",host=foo value=1.5 ") {
+		t.Fatalf("unexpected line protocol output: %q", line)
+	}
+
+	// md.Time is unix seconds; line protocol's default precision is
+	// nanoseconds, so the trailing timestamp must be scaled up by 1e9.
+	wantTS := fmt.Sprintf("%d", md.Time*1e9)
+	gotTS := line[strings.LastIndex(line, " ")+1:]
+	if gotTS != wantTS {
+		t.Fatalf("expected nanosecond timestamp %s, got %s", wantTS, gotTS)
+	}
+}
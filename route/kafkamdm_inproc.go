@@ -0,0 +1,153 @@
+package route
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	bolt "go.etcd.io/bbolt"
+)
+
+const inprocScheme = "inproc://"
+
+// inprocMessages is the single boltdb bucket holding all persisted messages,
+// keyed by partitionKey so a partition's messages stay in append order.
+var inprocMessages = []byte("messages")
+
+// parseInprocBroker reports whether brokers designates the embedded
+// in-process backend, i.e. a single "inproc://<path-to-boltdb-file>" entry,
+// and if so returns the store path. This lets a route be declared as
+// `brokers: ["inproc:///var/lib/carbon-relay-ng/kafkamdm.db"]` without any
+// other config changes.
+func parseInprocBroker(brokers []string) (path string, ok bool) {
+	if len(brokers) != 1 || !strings.HasPrefix(brokers[0], inprocScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(brokers[0], inprocScheme), true
+}
+
+// inprocBroker is a minimal, single-node stand-in for a Kafka cluster, backed
+// by a boltdb file so buffered metrics survive a process restart. It
+// implements sarama.AsyncProducer in full (Input/Successes/Errors are the
+// only methods KafkaMdm.run() actually drives; the transactional methods are
+// unsupported stubs, see below), so the rest of run() is unaware whether
+// it's talking to a real broker or this one. It is meant for tests and small
+// single-node deployments, not as a general sarama broker.
+type inprocBroker struct {
+	db            *bolt.DB
+	numPartitions int32
+
+	input     chan *sarama.ProducerMessage
+	successes chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+
+	closed chan struct{}
+}
+
+// newInprocBroker opens (creating if necessary) the boltdb file at path and
+// starts the background loop that persists incoming messages.
+func newInprocBroker(path string, numPartitions int32) (*inprocBroker, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open in-process kafka store %q: %s", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(inprocMessages)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize in-process kafka store %q: %s", path, err)
+	}
+
+	// the channels are buffered like sarama's own producer channels
+	// (Config.ChannelBufferSize defaults to 256), so a caller can queue
+	// several messages before reading their acks.
+	b := &inprocBroker{
+		db:            db,
+		numPartitions: numPartitions,
+		input:         make(chan *sarama.ProducerMessage, 256),
+		successes:     make(chan *sarama.ProducerMessage, 256),
+		errors:        make(chan *sarama.ProducerError, 256),
+		closed:        make(chan struct{}),
+	}
+	go b.loop()
+	return b, nil
+}
+
+func (b *inprocBroker) loop() {
+	defer close(b.closed)
+	// closing these once input is drained lets consumers ranging over
+	// Successes()/Errors() return after Close().
+	defer close(b.errors)
+	defer close(b.successes)
+	for msg := range b.input {
+		val, err := msg.Value.Encode()
+		if err != nil {
+			b.errors <- &sarama.ProducerError{Msg: msg, Err: err}
+			continue
+		}
+		err = b.db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(inprocMessages)
+			seq, err := bucket.NextSequence()
+			if err != nil {
+				return err
+			}
+			return bucket.Put(partitionKey(msg.Partition, seq), val)
+		})
+		if err != nil {
+			b.errors <- &sarama.ProducerError{Msg: msg, Err: err}
+			continue
+		}
+		b.successes <- msg
+	}
+}
+
+// partitionKey encodes (partition, sequence) so boltdb's natural
+// lexicographic key ordering preserves per-partition append order, which is
+// all the rest of KafkaMdm relies on from the partition/partitioner contract.
+func partitionKey(partition int32, seq uint64) []byte {
+	key := make([]byte, 12)
+	binary.BigEndian.PutUint32(key[:4], uint32(partition))
+	binary.BigEndian.PutUint64(key[4:], seq)
+	return key
+}
+
+func (b *inprocBroker) Input() chan<- *sarama.ProducerMessage     { return b.input }
+func (b *inprocBroker) Successes() <-chan *sarama.ProducerMessage { return b.successes }
+func (b *inprocBroker) Errors() <-chan *sarama.ProducerError      { return b.errors }
+
+func (b *inprocBroker) AsyncClose() {
+	close(b.input)
+}
+
+func (b *inprocBroker) Close() error {
+	b.AsyncClose()
+	<-b.closed
+	return b.db.Close()
+}
+
+// errInprocTransactionsNotSupported is returned by every transactional
+// method below: the embedded store is a single-node stand-in for tests and
+// small deployments, and has no notion of a transaction coordinator.
+var errInprocTransactionsNotSupported = fmt.Errorf("inprocBroker: transactional producer is not supported")
+
+func (b *inprocBroker) IsTransactional() bool { return false }
+
+func (b *inprocBroker) TxnStatus() sarama.ProducerTxnStatusFlag { return 0 }
+
+func (b *inprocBroker) BeginTxn() error { return errInprocTransactionsNotSupported }
+
+func (b *inprocBroker) CommitTxn() error { return errInprocTransactionsNotSupported }
+
+func (b *inprocBroker) AbortTxn() error { return errInprocTransactionsNotSupported }
+
+func (b *inprocBroker) AddOffsetsToTxn(offsets map[string][]*sarama.PartitionOffsetMetadata, groupId string) error {
+	return errInprocTransactionsNotSupported
+}
+
+func (b *inprocBroker) AddMessageToTxn(msg *sarama.ConsumerMessage, groupId string, metadata *string) error {
+	return errInprocTransactionsNotSupported
+}
@@ -0,0 +1,114 @@
+package route
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	bolt "go.etcd.io/bbolt"
+)
+
+// compile-time assertion that inprocBroker satisfies sarama.AsyncProducer in
+// full, transactional stubs included.
+var _ sarama.AsyncProducer = (*inprocBroker)(nil)
+
+func TestParseInprocBroker(t *testing.T) {
+	if _, ok := parseInprocBroker([]string{"localhost:9092"}); ok {
+		t.Fatalf("expected a real broker address not to be treated as inproc")
+	}
+	if _, ok := parseInprocBroker([]string{"inproc:///tmp/a.db", "inproc:///tmp/b.db"}); ok {
+		t.Fatalf("expected multiple brokers not to be treated as inproc")
+	}
+	path, ok := parseInprocBroker([]string{"inproc:///tmp/kafkamdm.db"})
+	if !ok {
+		t.Fatalf("expected a single inproc:// entry to be recognized")
+	}
+	if path != "/tmp/kafkamdm.db" {
+		t.Fatalf("expected path /tmp/kafkamdm.db, got %q", path)
+	}
+}
+
+func TestInprocBrokerProduceSuccess(t *testing.T) {
+	b, err := newInprocBroker(filepath.Join(t.TempDir(), "kafkamdm.db"), 1)
+	if err != nil {
+		t.Fatalf("newInprocBroker: %s", err)
+	}
+	defer b.Close()
+
+	msg := &sarama.ProducerMessage{Partition: 0, Value: sarama.ByteEncoder("hello")}
+	b.Input() <- msg
+
+	select {
+	case got := <-b.Successes():
+		if got != msg {
+			t.Fatalf("expected the same message back on Successes()")
+		}
+	case err := <-b.Errors():
+		t.Fatalf("expected success, got error: %s", err.Err)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for ack")
+	}
+}
+
+func TestInprocBrokerPreservesPartitionOrder(t *testing.T) {
+	b, err := newInprocBroker(filepath.Join(t.TempDir(), "kafkamdm.db"), 1)
+	if err != nil {
+		t.Fatalf("newInprocBroker: %s", err)
+	}
+	defer b.Close()
+
+	want := []string{"one", "two", "three"}
+	for _, v := range want {
+		b.Input() <- &sarama.ProducerMessage{Partition: 0, Value: sarama.ByteEncoder(v)}
+	}
+	for range want {
+		select {
+		case <-b.Successes():
+		case err := <-b.Errors():
+			t.Fatalf("unexpected error: %s", err.Err)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for ack")
+		}
+	}
+
+	var got []string
+	err = b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(inprocMessages).ForEach(func(_, v []byte) error {
+			got = append(got, string(v))
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatalf("reading back persisted messages: %s", err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d persisted messages, got %d", len(want), len(got))
+	}
+	for i, v := range want {
+		if got[i] != v {
+			t.Errorf("message %d: expected %q, got %q (partition order not preserved)", i, v, got[i])
+		}
+	}
+}
+
+func TestInprocBrokerTransactionalStubs(t *testing.T) {
+	b, err := newInprocBroker(filepath.Join(t.TempDir(), "kafkamdm.db"), 1)
+	if err != nil {
+		t.Fatalf("newInprocBroker: %s", err)
+	}
+	defer b.Close()
+
+	if b.IsTransactional() {
+		t.Fatalf("expected IsTransactional to be false")
+	}
+	if err := b.BeginTxn(); err != errInprocTransactionsNotSupported {
+		t.Fatalf("expected errInprocTransactionsNotSupported, got %v", err)
+	}
+	if err := b.CommitTxn(); err != errInprocTransactionsNotSupported {
+		t.Fatalf("expected errInprocTransactionsNotSupported, got %v", err)
+	}
+	if err := b.AbortTxn(); err != errInprocTransactionsNotSupported {
+		t.Fatalf("expected errInprocTransactionsNotSupported, got %v", err)
+	}
+}
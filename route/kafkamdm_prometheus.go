@@ -0,0 +1,226 @@
+package route
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	rcrowleymetrics "github.com/rcrowley/go-metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// kafkaMdmPromLabels is the label set every KafkaMdm prometheus metric
+// carries, so a single route/topic/broker combination can be picked out
+// regardless of which collector it came from.
+var kafkaMdmPromLabels = []string{"route", "topic", "broker"}
+
+var (
+	promNumOut = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "carbon_relay_ng",
+		Subsystem: "kafka_mdm",
+		Name:      "metrics_out_total",
+		Help:      "Metrics successfully written to kafka.",
+	}, kafkaMdmPromLabels)
+	promNumErrFlush = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "carbon_relay_ng",
+		Subsystem: "kafka_mdm",
+		Name:      "flush_errors_total",
+		Help:      "Messages kafka failed to accept. Each is retried individually, up to a retry limit.",
+	}, kafkaMdmPromLabels)
+	promNumDropBuffFull = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "carbon_relay_ng",
+		Subsystem: "kafka_mdm",
+		Name:      "buffer_full_drops_total",
+		Help:      "Metrics dropped because the in-memory buffer was full.",
+	}, kafkaMdmPromLabels)
+	promNumBuffered = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "carbon_relay_ng",
+		Subsystem: "kafka_mdm",
+		Name:      "buffered_metrics",
+		Help:      "Metrics currently sitting in the in-memory buffer.",
+	}, kafkaMdmPromLabels)
+	promBufferSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "carbon_relay_ng",
+		Subsystem: "kafka_mdm",
+		Name:      "buffer_size",
+		Help:      "Capacity of the in-memory buffer.",
+	}, kafkaMdmPromLabels)
+	promTickFlushSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "carbon_relay_ng",
+		Subsystem: "kafka_mdm",
+		Name:      "flush_size_bytes",
+		Help:      "Size in bytes of each batch submitted to kafka.",
+		Buckets:   prometheus.ExponentialBuckets(64, 4, 10),
+	}, kafkaMdmPromLabels)
+	promDurationTickFlush = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "carbon_relay_ng",
+		Subsystem: "kafka_mdm",
+		Name:      "flush_duration_seconds",
+		Help:      "Time taken to hand a batch off to the producer.",
+	}, kafkaMdmPromLabels)
+	// promSaramaMetric mirrors sarama's own go-metrics registry (batch size,
+	// request latency, records-per-request, ...) under an extra "metric"
+	// label, so producer health shows up on the same /metrics endpoint.
+	promSaramaMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "carbon_relay_ng",
+		Subsystem: "kafka_mdm",
+		Name:      "sarama_metric",
+		Help:      "Mirror of sarama's internal go-metrics registry.",
+	}, append(append([]string{}, kafkaMdmPromLabels...), "metric"))
+	promNumSpilled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "carbon_relay_ng",
+		Subsystem: "kafka_mdm",
+		Name:      "spilled_total",
+		Help:      "Metrics written to the spillover WAL because the buffer was above its high-water mark.",
+	}, kafkaMdmPromLabels)
+	promSpillBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "carbon_relay_ng",
+		Subsystem: "kafka_mdm",
+		Name:      "spill_bytes_total",
+		Help:      "Bytes written to the spillover WAL.",
+	}, kafkaMdmPromLabels)
+	promNumReplayed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "carbon_relay_ng",
+		Subsystem: "kafka_mdm",
+		Name:      "replayed_total",
+		Help:      "Metrics re-injected into the buffer from the spillover WAL.",
+	}, kafkaMdmPromLabels)
+)
+
+func init() {
+	prometheus.MustRegister(
+		promNumOut,
+		promNumErrFlush,
+		promNumDropBuffFull,
+		promNumBuffered,
+		promBufferSize,
+		promTickFlushSize,
+		promDurationTickFlush,
+		promSaramaMetric,
+		promNumSpilled,
+		promSpillBytes,
+		promNumReplayed,
+	)
+}
+
+// kafkaMdmPromMetrics holds the prometheus collectors for a single KafkaMdm
+// route, pre-bound to its route/topic/broker label values. numDropBuffFull is
+// tracked as a last-seen count and mirrored from its go-metrics counterpart
+// on a ticker (see mirrorDropCounter) since it can be incremented from the
+// shared dispatchBlocking/dispatchNonBlocking helpers, outside our call sites.
+type kafkaMdmPromMetrics struct {
+	numOut            prometheus.Counter
+	numErrFlush       prometheus.Counter
+	numDropBuffFull   prometheus.Counter
+	numBuffered       prometheus.Gauge
+	bufferSize        prometheus.Gauge
+	tickFlushSize     prometheus.Observer
+	durationTickFlush prometheus.Observer
+	numSpilled        prometheus.Counter
+	spillBytes        prometheus.Counter
+	numReplayed       prometheus.Counter
+
+	lastDropBuffFull int64
+}
+
+func newKafkaMdmPromMetrics(route, topic, broker string) *kafkaMdmPromMetrics {
+	labels := prometheus.Labels{"route": route, "topic": topic, "broker": broker}
+	return &kafkaMdmPromMetrics{
+		numOut:            promNumOut.With(labels),
+		numErrFlush:       promNumErrFlush.With(labels),
+		numDropBuffFull:   promNumDropBuffFull.With(labels),
+		numSpilled:        promNumSpilled.With(labels),
+		spillBytes:        promSpillBytes.With(labels),
+		numReplayed:       promNumReplayed.With(labels),
+		numBuffered:       promNumBuffered.With(labels),
+		bufferSize:        promBufferSize.With(labels),
+		tickFlushSize:     promTickFlushSize.With(labels),
+		durationTickFlush: promDurationTickFlush.With(labels),
+	}
+}
+
+// mirrorDropCounter periodically syncs numDropBuffFull (a go-metrics Counter
+// updated from outside this file) into its prometheus counterpart, until
+// done is closed by Shutdown().
+func (r *KafkaMdm) mirrorDropCounter() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			count := r.numDropBuffFull.Count()
+			if d := count - r.prom.lastDropBuffFull; d > 0 {
+				r.prom.numDropBuffFull.Add(float64(d))
+			}
+			r.prom.lastDropBuffFull = count
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// registerSaramaMetrics starts a background goroutine that periodically
+// mirrors sarama's go-metrics registry into prometheus under the given
+// route/topic/broker labels, until done is closed.
+func registerSaramaMetrics(registry rcrowleymetrics.Registry, route, topic, broker string, done <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				registry.Each(func(name string, metric interface{}) {
+					var value float64
+					switch m := metric.(type) {
+					case rcrowleymetrics.Counter:
+						value = float64(m.Count())
+					case rcrowleymetrics.Gauge:
+						value = float64(m.Value())
+					case rcrowleymetrics.Meter:
+						value = m.Snapshot().RateMean()
+					case rcrowleymetrics.Histogram:
+						value = m.Snapshot().Mean()
+					case rcrowleymetrics.Timer:
+						value = m.Snapshot().Mean()
+					default:
+						return
+					}
+					promSaramaMetric.WithLabelValues(route, topic, broker, name).Set(value)
+				})
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// metricsServers tracks which addresses already have a /metrics listener, so
+// that multiple KafkaMdm routes configured with the same promListenAddr share
+// one http.Server instead of each trying (and failing) to bind it.
+var (
+	metricsServersMu sync.Mutex
+	metricsServers   = map[string]bool{}
+)
+
+// startMetricsServer lazily starts an HTTP server on addr exposing the
+// prometheus /metrics handler. There's no admin HTTP server in this tree for
+// KafkaMdm to plug into, so each route that sets promListenAddr gets this
+// minimal, self-contained one instead.
+func startMetricsServer(addr string) {
+	metricsServersMu.Lock()
+	defer metricsServersMu.Unlock()
+	if metricsServers[addr] {
+		return
+	}
+	metricsServers[addr] = true
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Errorf("kafkaMdm: prometheus metrics server on %s stopped: %s", addr, err)
+		}
+	}()
+}
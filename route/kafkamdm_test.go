@@ -0,0 +1,195 @@
+package route
+
+import (
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Dieterbe/go-metrics"
+	"github.com/Shopify/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newTestInprocRoute(t *testing.T) (*KafkaMdm, *inprocBroker) {
+	t.Helper()
+	b, err := newInprocBroker(filepath.Join(t.TempDir(), "kafkamdm.db"), 1)
+	if err != nil {
+		t.Fatalf("newInprocBroker: %s", err)
+	}
+	r := &KafkaMdm{
+		baseRoute: baseRoute{sync.Mutex{}, atomic.Value{}, "test"},
+		producer:  b,
+		done:      make(chan struct{}),
+	}
+	return r, b
+}
+
+func TestRetryResubmitsBelowMaxRetries(t *testing.T) {
+	r, b := newTestInprocRoute(t)
+	defer b.Close()
+
+	meta := kafkaMdmMsgMeta{metric: testMetricData(), size: 5, retries: 0}
+	msg := &sarama.ProducerMessage{Partition: 0, Value: sarama.ByteEncoder("hello"), Metadata: meta}
+
+	atomic.StoreInt64(&r.inFlight, int64(meta.size))
+	r.retry(msg, meta)
+
+	select {
+	case got := <-b.Successes():
+		resubmitted := got.Metadata.(kafkaMdmMsgMeta)
+		if resubmitted.retries != 1 {
+			t.Fatalf("expected retries to be incremented to 1, got %d", resubmitted.retries)
+		}
+	case err := <-b.Errors():
+		t.Fatalf("unexpected error resubmitting: %s", err.Err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for resubmitted message to be acked")
+	}
+	// retry() itself never touches r.inFlight on a non-terminal attempt -
+	// that's drainSuccesses's job once the resubmission is acked.
+	if got := atomic.LoadInt64(&r.inFlight); got != int64(meta.size) {
+		t.Fatalf("expected inFlight to be untouched by retry(), got %d", got)
+	}
+}
+
+func TestRetryGivesUpAfterMaxRetries(t *testing.T) {
+	r, b := newTestInprocRoute(t)
+	defer b.Close()
+
+	meta := kafkaMdmMsgMeta{metric: testMetricData(), size: 7, retries: kafkaMdmMaxRetries}
+	msg := &sarama.ProducerMessage{Partition: 0, Value: sarama.ByteEncoder("hello"), Metadata: meta}
+
+	atomic.StoreInt64(&r.inFlight, int64(meta.size))
+	r.retry(msg, meta)
+
+	if got := atomic.LoadInt64(&r.inFlight); got != 0 {
+		t.Fatalf("expected giving up to release the in-flight bytes, got inFlight=%d", got)
+	}
+
+	select {
+	case <-b.Successes():
+		t.Fatal("did not expect a give-up retry to be resubmitted")
+	case <-b.Errors():
+		t.Fatal("did not expect a give-up retry to be resubmitted")
+	case <-time.After(100 * time.Millisecond):
+		// nothing resubmitted, as expected.
+	}
+}
+
+func TestDrainSuccessesReleasesInFlightBytes(t *testing.T) {
+	r, b := newTestInprocRoute(t)
+	defer b.Close()
+
+	r.numOut = metrics.NewCounter()
+	r.prom = &kafkaMdmPromMetrics{numOut: prometheus.NewCounter(prometheus.CounterOpts{Name: "test_kafkamdm_num_out"})}
+
+	meta := kafkaMdmMsgMeta{metric: testMetricData(), size: 42}
+	atomic.StoreInt64(&r.inFlight, int64(meta.size))
+
+	go r.drainSuccesses()
+	b.Input() <- &sarama.ProducerMessage{Partition: 0, Value: sarama.ByteEncoder("hello"), Metadata: meta}
+
+	deadline := time.After(2 * time.Second)
+	for atomic.LoadInt64(&r.inFlight) != 0 {
+		select {
+		case <-deadline:
+			t.Fatalf("timed out waiting for inFlight to be released, still at %d", atomic.LoadInt64(&r.inFlight))
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// TestRetryAbortsOnDone covers the shutdown race fixed alongside this test: a
+// retry() blocked in its backoff sleep must give up and release its in-flight
+// bytes as soon as r.done is closed, instead of going on to send to a
+// producer that Shutdown() may already be closing.
+func TestRetryAbortsOnDone(t *testing.T) {
+	r, b := newTestInprocRoute(t)
+	defer b.Close()
+
+	// retries=1 gives a 200ms backoff, plenty of time to close r.done first.
+	meta := kafkaMdmMsgMeta{metric: testMetricData(), size: 9, retries: 1}
+	msg := &sarama.ProducerMessage{Partition: 0, Value: sarama.ByteEncoder("hello"), Metadata: meta}
+	atomic.StoreInt64(&r.inFlight, int64(meta.size))
+
+	done := make(chan struct{})
+	go func() {
+		r.retry(msg, meta)
+		close(done)
+	}()
+
+	close(r.done)
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("retry() did not return after r.done was closed")
+	}
+	if got := atomic.LoadInt64(&r.inFlight); got != 0 {
+		t.Fatalf("expected aborted retry to release in-flight bytes, got inFlight=%d", got)
+	}
+
+	select {
+	case <-b.Successes():
+		t.Fatal("did not expect an aborted retry to be resubmitted")
+	case <-b.Errors():
+		t.Fatal("did not expect an aborted retry to be resubmitted")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestReplaySealedSegmentsAbortsOnDone covers the other half of the same
+// shutdown race: replaySealedSegments must not block forever (or panic on a
+// closed r.buf) trying to hand a replayed record to a full buffer once
+// Shutdown() has signaled r.done.
+func TestReplaySealedSegmentsAbortsOnDone(t *testing.T) {
+	w, err := newWAL(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatalf("newWAL: %s", err)
+	}
+	if err := w.Write([]byte("stuck record")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if err := w.rotate(); err != nil {
+		t.Fatalf("rotate: %s", err)
+	}
+
+	r := &KafkaMdm{
+		baseRoute: baseRoute{sync.Mutex{}, atomic.Value{}, "test"},
+		wal:       w,
+		buf:       make(chan []byte), // unbuffered: the replay send below blocks until r.done is closed
+		done:      make(chan struct{}),
+	}
+	r.numBuffered = metrics.NewGauge()
+	r.numReplayed = metrics.NewCounter()
+	r.prom = &kafkaMdmPromMetrics{
+		numBuffered: prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_kafkamdm_num_buffered"}),
+		numReplayed: prometheus.NewCounter(prometheus.CounterOpts{Name: "test_kafkamdm_num_replayed"}),
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- r.replaySealedSegments() }()
+
+	close(r.done)
+
+	select {
+	case err := <-errCh:
+		if err != errReplayAborted {
+			t.Fatalf("expected errReplayAborted, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("replaySealedSegments did not abort after r.done was closed")
+	}
+
+	// the segment was never fully consumed, so it must still be on disk to
+	// be picked up again on the next replay pass.
+	segments, err := w.segments()
+	if err != nil {
+		t.Fatalf("segments: %s", err)
+	}
+	if len(segments) != 1 {
+		t.Fatalf("expected the aborted segment to remain on disk, got %v", segments)
+	}
+}
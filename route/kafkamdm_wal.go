@@ -0,0 +1,200 @@
+package route
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// walSegmentBytes is the size at which the WAL rotates to a fresh segment.
+const walSegmentBytes = 16 * 1024 * 1024
+
+// ErrWALFull is returned by wal.Write once the WAL has reached maxBytes.
+var ErrWALFull = fmt.Errorf("spillover WAL is full")
+
+// wal is a simple append-only, segmented write-ahead log used by KafkaMdm's
+// spillover dispatch mode to hold metrics on disk while the in-memory buffer
+// is above its high-water mark, without growing unbounded RAM usage. Each
+// segment is a flat file of length-prefixed records; a segment is fsynced
+// and closed for writing as soon as it rotates, and removed once fully
+// replayed back into the in-memory buffer.
+type wal struct {
+	dir      string
+	maxBytes int64
+
+	mu        sync.Mutex
+	usedBytes int64
+	writeSeg  *os.File
+	writeSize int64
+	nextSeq   int
+}
+
+func newWAL(dir string, maxBytes int64) (*wal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create spillover dir %q: %s", dir, err)
+	}
+	w := &wal{dir: dir, maxBytes: maxBytes}
+
+	segments, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range segments {
+		fi, err := os.Stat(seg)
+		if err != nil {
+			return nil, err
+		}
+		w.usedBytes += fi.Size()
+		if seq, err := segmentSeq(seg); err == nil && seq >= w.nextSeq {
+			w.nextSeq = seq + 1
+		}
+	}
+	return w, nil
+}
+
+func (w *wal) segmentPath(seq int) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%010d.seg", seq))
+}
+
+func segmentSeq(path string) (int, error) {
+	return strconv.Atoi(strings.TrimSuffix(filepath.Base(path), ".seg"))
+}
+
+// segments returns the existing segment files on disk, oldest first.
+func (w *wal) segments() ([]string, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []string
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".seg") {
+			segments = append(segments, filepath.Join(w.dir, e.Name()))
+		}
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// sealedSegments returns the existing segments excluding the one currently
+// open for writes, so a concurrent replay never reads a record that's still
+// being appended.
+func (w *wal) sealedSegments() ([]string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var current string
+	if w.writeSeg != nil {
+		current = w.writeSeg.Name()
+	}
+
+	segments, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+	sealed := segments[:0]
+	for _, seg := range segments {
+		if seg != current {
+			sealed = append(sealed, seg)
+		}
+	}
+	return sealed, nil
+}
+
+// Write appends buf as a new record, rotating to a fresh segment if needed,
+// and fails with ErrWALFull once maxBytes worth of segments are on disk.
+func (w *wal) Write(buf []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.usedBytes+int64(len(buf))+4 > w.maxBytes {
+		return ErrWALFull
+	}
+	if w.writeSeg != nil && w.writeSize >= walSegmentBytes {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	if w.writeSeg == nil {
+		f, err := os.OpenFile(w.segmentPath(w.nextSeq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		w.nextSeq++
+		w.writeSeg = f
+		w.writeSize = 0
+	}
+
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(len(buf)))
+	if _, err := w.writeSeg.Write(lenBuf[:]); err != nil {
+		return err
+	}
+	if _, err := w.writeSeg.Write(buf); err != nil {
+		return err
+	}
+	n := int64(len(lenBuf) + len(buf))
+	w.writeSize += n
+	w.usedBytes += n
+	return nil
+}
+
+// rotate fsyncs and closes the current segment, if any, sealing it for
+// replay. The next Write opens a fresh segment.
+func (w *wal) rotate() error {
+	if w.writeSeg == nil {
+		return nil
+	}
+	if err := w.writeSeg.Sync(); err != nil {
+		return err
+	}
+	if err := w.writeSeg.Close(); err != nil {
+		return err
+	}
+	w.writeSeg = nil
+	w.writeSize = 0
+	return nil
+}
+
+// replaySegment reads every record in path, invoking fn for each, then
+// removes the segment once it's been fully consumed.
+func (w *wal) replaySegment(path string, fn func([]byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var read int64
+	for {
+		var lenBuf [4]byte
+		_, err := io.ReadFull(r, lenBuf[:])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		size := binary.BigEndian.Uint32(lenBuf[:])
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return err
+		}
+		if err := fn(buf); err != nil {
+			return err
+		}
+		read += int64(len(lenBuf)) + int64(size)
+	}
+
+	w.mu.Lock()
+	w.usedBytes -= read
+	w.mu.Unlock()
+	return os.Remove(path)
+}